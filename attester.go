@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-tpm/legacy/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/hf/nsm"
+	"github.com/hf/nsm/request"
+)
+
+// Attester generates a key inside an attestable environment (a Nitro
+// Enclave or a TPM) and proves, via a hardware-signed attestation document
+// binding the public key, that the corresponding private key never existed
+// outside it.
+type Attester interface {
+	GenerateAttestedKey(spec KeySpec) (pub crypto.PublicKey, signer crypto.Signer, attestation []byte, format string, err error)
+}
+
+// nitroAttester generates keys inside an AWS Nitro Enclave, drawing entropy
+// from the Nitro Secure Module's GetRandom request and binding the
+// resulting public key into an NSM Attestation request's user_data field.
+type nitroAttester struct{}
+
+func newNitroAttester() *nitroAttester {
+	return &nitroAttester{}
+}
+
+func (a *nitroAttester) GenerateAttestedKey(spec KeySpec) (crypto.PublicKey, crypto.Signer, []byte, string, error) {
+	session, err := nsm.OpenDefaultSession()
+	if err != nil {
+		return nil, nil, nil, "", fmt.Errorf("opening NSM session: %w", err)
+	}
+	defer session.Close()
+
+	bits := 2048
+	if spec.Algorithm == "RSA_4096" {
+		bits = 4096
+	}
+	privateKey, err := rsa.GenerateKey(&nsmReader{session: session}, bits)
+	if err != nil {
+		return nil, nil, nil, "", fmt.Errorf("generating attested key: %w", err)
+	}
+	if err := privateKey.Validate(); err != nil {
+		return nil, nil, nil, "", err
+	}
+
+	userData, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+
+	res, err := session.Send(&request.Attestation{UserData: userData})
+	if err != nil {
+		return nil, nil, nil, "", fmt.Errorf("requesting NSM attestation: %w", err)
+	}
+	if res.Error != "" {
+		return nil, nil, nil, "", fmt.Errorf("NSM Attestation: %s", res.Error)
+	}
+
+	return &privateKey.PublicKey, privateKey, res.Attestation.Document, "nitro", nil
+}
+
+// nsmReader is an io.Reader backed by repeated NSM GetRandom requests, so
+// keys generated for Nitro attestation draw their entropy from the enclave's
+// hardware RNG rather than the process's own.
+type nsmReader struct {
+	session *nsm.Session
+}
+
+func (r *nsmReader) Read(p []byte) (int, error) {
+	total := 0
+	for total < len(p) {
+		res, err := r.session.Send(&request.GetRandom{})
+		if err != nil {
+			return total, err
+		}
+		if res.Error != "" {
+			return total, fmt.Errorf("NSM GetRandom: %s", res.Error)
+		}
+		n := copy(p[total:], res.GetRandom.Random)
+		if n == 0 {
+			return total, errors.New("NSM GetRandom returned no data")
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// tpmAttester generates keys inside a TPM 2.0, persists the resulting
+// handle, and certifies it with TPM2_Certify under a previously-provisioned
+// Attestation Key (AK), so a relying party can verify the private key never
+// left the TPM.
+type tpmAttester struct {
+	devicePath string
+	akHandle   tpmutil.Handle
+}
+
+func newTPMAttester(akHandle tpmutil.Handle) *tpmAttester {
+	return &tpmAttester{devicePath: "/dev/tpmrm0", akHandle: akHandle}
+}
+
+func (a *tpmAttester) GenerateAttestedKey(spec KeySpec) (crypto.PublicKey, crypto.Signer, []byte, string, error) {
+	rwc, err := tpm2.OpenTPM(a.devicePath)
+	if err != nil {
+		return nil, nil, nil, "", fmt.Errorf("opening TPM: %w", err)
+	}
+	defer rwc.Close()
+
+	template := tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSign | tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagSensitiveDataOrigin | tpm2.FlagUserWithAuth,
+		RSAParameters: &tpm2.RSAParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256},
+			KeyBits: keyBitsFor(spec.Algorithm),
+		},
+	}
+
+	keyHandle, pub, err := tpm2.CreatePrimary(rwc, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", template)
+	if err != nil {
+		return nil, nil, nil, "", fmt.Errorf("creating TPM key: %w", err)
+	}
+	defer tpm2.FlushContext(rwc, keyHandle)
+
+	persistentHandle, err := a.persist(rwc, keyHandle)
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+
+	attestation, signature, err := tpm2.Certify(rwc, "", "", keyHandle, a.akHandle, nil)
+	if err != nil {
+		return nil, nil, nil, "", fmt.Errorf("certifying TPM key: %w", err)
+	}
+	document, err := tpmutil.Pack(attestation, signature)
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+
+	return pub, &tpmSigner{devicePath: a.devicePath, handle: persistentHandle, public: pub}, document, "tpm", nil
+}
+
+// persist moves a transient key handle to a well-known persistent handle so
+// it outlives this TPM2_CreatePrimary call and can be used later by
+// tpmSigner.
+func (a *tpmAttester) persist(rwc io.ReadWriter, transient tpmutil.Handle) (tpmutil.Handle, error) {
+	persistentHandle := tpmutil.Handle(0x81020000 + uint32(transient)%0x10000)
+	if err := tpm2.EvictControl(rwc, "", tpm2.HandleOwner, transient, persistentHandle); err != nil {
+		return 0, fmt.Errorf("persisting TPM key: %w", err)
+	}
+	return persistentHandle, nil
+}
+
+func keyBitsFor(algorithm string) uint16 {
+	if algorithm == "RSA_4096" {
+		return 4096
+	}
+	return 2048
+}
+
+// tpmSigner implements crypto.Signer by calling TPM2_Sign through a
+// persisted key handle for every signature, so the private key never leaves
+// the TPM.
+type tpmSigner struct {
+	devicePath string
+	handle     tpmutil.Handle
+	public     crypto.PublicKey
+}
+
+func (s *tpmSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *tpmSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	rwc, err := tpm2.OpenTPM(s.devicePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rwc.Close()
+
+	sig, err := tpm2.Sign(rwc, s.handle, "", digest, nil, &tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256})
+	if err != nil {
+		return nil, err
+	}
+	return sig.RSA.Signature, nil
+}
+
+// attesterFor selects an Attester implementation for the given
+// "Attestation" ResourceProperty value.
+func attesterFor(kind, attestationKeyHandle string) (Attester, error) {
+	switch kind {
+	case "nitro":
+		return newNitroAttester(), nil
+	case "tpm":
+		akHandle, err := parseTPMHandle(attestationKeyHandle)
+		if err != nil {
+			return nil, err
+		}
+		return newTPMAttester(akHandle), nil
+	default:
+		return nil, fmt.Errorf("unknown Attestation %q", kind)
+	}
+}
+
+// parseTPMHandle parses an "AttestationKeyHandle" property such as
+// "0x81010002" into the tpmutil.Handle of a previously-provisioned
+// Attestation Key used to sign TPM2_Certify structures.
+func parseTPMHandle(s string) (tpmutil.Handle, error) {
+	if s == "" {
+		return 0, errors.New("Missing required property 'AttestationKeyHandle' for Attestation 'tpm'")
+	}
+	handle, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("parsing AttestationKeyHandle: %w", err)
+	}
+	return tpmutil.Handle(handle), nil
+}
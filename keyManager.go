@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// KeySpec describes the key a caller wants a KeyManager to produce.
+type KeySpec struct {
+	Name      string
+	Algorithm string // e.g. "RSA_2048", "RSA_4096", "ECC_NIST_P256"
+}
+
+// KeyManager abstracts over where an asymmetric key's private half actually
+// lives. Implementations must never return the private key material itself -
+// only a crypto.Signer capable of using it and the corresponding public key.
+type KeyManager interface {
+	CreateKey(spec KeySpec) (name string, publicKey crypto.PublicKey, signer crypto.Signer, err error)
+	GetPublicKey(name string) (crypto.PublicKey, error)
+}
+
+// softsignKeyManager generates keys in-process, the same way this Lambda has
+// always behaved. It remains the default so existing stacks and tests keep
+// working unchanged.
+type softsignKeyManager struct{}
+
+func newSoftsignKeyManager() *softsignKeyManager {
+	return &softsignKeyManager{}
+}
+
+func (m *softsignKeyManager) CreateKey(spec KeySpec) (string, crypto.PublicKey, crypto.Signer, error) {
+	bits := 2048
+	if spec.Algorithm == "RSA_4096" {
+		bits = 4096
+	}
+	privateKey, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if err := privateKey.Validate(); err != nil {
+		return "", nil, nil, err
+	}
+	return spec.Name, &privateKey.PublicKey, privateKey, nil
+}
+
+func (m *softsignKeyManager) GetPublicKey(name string) (crypto.PublicKey, error) {
+	return nil, errors.New("softsign KeyManager does not retain keys by name")
+}
+
+// awsKMSKeyManager creates asymmetric signing keys in AWS KMS so the private
+// key material never leaves the HSM boundary.
+type awsKMSKeyManager struct {
+	Client kmsiface.KMSAPI
+}
+
+func newAWSKMSKeyManager(client kmsiface.KMSAPI) *awsKMSKeyManager {
+	return &awsKMSKeyManager{Client: client}
+}
+
+func (m *awsKMSKeyManager) CreateKey(spec KeySpec) (string, crypto.PublicKey, crypto.Signer, error) {
+	algorithm := spec.Algorithm
+	if algorithm == "" {
+		algorithm = "RSA_2048"
+	}
+	req, out := m.Client.CreateKeyRequest(&kms.CreateKeyInput{
+		KeyUsage:              aws.String(kms.KeyUsageTypeSignVerify),
+		CustomerMasterKeySpec: aws.String(algorithm),
+		Description:           aws.String("secrethelper: " + spec.Name),
+	})
+	if err := req.Send(); err != nil {
+		return "", nil, nil, err
+	}
+	keyID := aws.StringValue(out.KeyMetadata.KeyId)
+
+	pub, err := m.GetPublicKey(keyID)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	return keyID, pub, &kmsSigner{client: m.Client, keyID: keyID, public: pub}, nil
+}
+
+func (m *awsKMSKeyManager) GetPublicKey(name string) (crypto.PublicKey, error) {
+	req, out := m.Client.GetPublicKeyRequest(&kms.GetPublicKeyInput{KeyId: aws.String(name)})
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(out.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// kmsSigner implements crypto.Signer by calling kms:Sign for every signature,
+// so the private key is never loaded outside of KMS.
+type kmsSigner struct {
+	client kmsiface.KMSAPI
+	keyID  string
+	public crypto.PublicKey
+}
+
+func (s *kmsSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *kmsSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	algorithm, err := signingAlgorithmFor(s.public, opts)
+	if err != nil {
+		return nil, err
+	}
+	req, out := s.client.SignRequest(&kms.SignInput{
+		KeyId:            aws.String(s.keyID),
+		Message:          digest,
+		MessageType:      aws.String(kms.MessageTypeDigest),
+		SigningAlgorithm: aws.String(algorithm),
+	})
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+	return out.Signature, nil
+}
+
+func signingAlgorithmFor(pub crypto.PublicKey, opts crypto.SignerOpts) (string, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		switch opts.HashFunc() {
+		case crypto.SHA256:
+			return kms.SigningAlgorithmSpecRsassaPkcs1V15Sha256, nil
+		case crypto.SHA512:
+			return kms.SigningAlgorithmSpecRsassaPkcs1V15Sha512, nil
+		default:
+			return "", fmt.Errorf("unsupported hash for RSA KMS signing: %v", opts.HashFunc())
+		}
+	default:
+		return kms.SigningAlgorithmSpecEcdsaSha256, nil
+	}
+}
+
+// cloudKMSKeyManager creates asymmetric signing keys in Google Cloud KMS.
+// It is a thin placeholder: wiring up the real Cloud KMS client libraries is
+// tracked separately, so CreateKey reports that it is not yet available
+// rather than silently generating a local key.
+type cloudKMSKeyManager struct {
+	KeyRing string
+}
+
+func newCloudKMSKeyManager(keyRing string) *cloudKMSKeyManager {
+	return &cloudKMSKeyManager{KeyRing: keyRing}
+}
+
+func (m *cloudKMSKeyManager) CreateKey(spec KeySpec) (string, crypto.PublicKey, crypto.Signer, error) {
+	return "", nil, nil, errors.New("cloudkms KeyBackend is not implemented yet")
+}
+
+func (m *cloudKMSKeyManager) GetPublicKey(name string) (crypto.PublicKey, error) {
+	return nil, errors.New("cloudkms KeyBackend is not implemented yet")
+}
+
+// pkcs11KeyManager creates keys on a PKCS#11 token (an on-prem HSM). Like
+// cloudKMSKeyManager this is a placeholder until a PKCS#11 module path and
+// session handling is added.
+type pkcs11KeyManager struct {
+	ModulePath string
+}
+
+func newPKCS11KeyManager(modulePath string) *pkcs11KeyManager {
+	return &pkcs11KeyManager{ModulePath: modulePath}
+}
+
+func (m *pkcs11KeyManager) CreateKey(spec KeySpec) (string, crypto.PublicKey, crypto.Signer, error) {
+	return "", nil, nil, errors.New("pkcs11 KeyBackend is not implemented yet")
+}
+
+func (m *pkcs11KeyManager) GetPublicKey(name string) (crypto.PublicKey, error) {
+	return nil, errors.New("pkcs11 KeyBackend is not implemented yet")
+}
+
+// yubikeyKeyManager creates keys in a YubiKey's PIV applet. Lambda has no USB
+// access, so this backend only makes sense when secrethelper is invoked
+// outside of AWS; it is included for completeness and is a placeholder today.
+type yubikeyKeyManager struct {
+	Slot string
+}
+
+func newYubikeyKeyManager(slot string) *yubikeyKeyManager {
+	return &yubikeyKeyManager{Slot: slot}
+}
+
+func (m *yubikeyKeyManager) CreateKey(spec KeySpec) (string, crypto.PublicKey, crypto.Signer, error) {
+	return "", nil, nil, errors.New("yubikey KeyBackend is not implemented yet")
+}
+
+func (m *yubikeyKeyManager) GetPublicKey(name string) (crypto.PublicKey, error) {
+	return nil, errors.New("yubikey KeyBackend is not implemented yet")
+}
+
+// keyManagerFor selects a KeyManager implementation for the given
+// ResourceProperty "KeyBackend" value, defaulting to softsign so existing
+// stacks and tests are unaffected. cloudkms, pkcs11 and yubikey are rejected
+// here rather than at CreateKey time, since their KeyManagers are
+// placeholders with no working implementation yet.
+func keyManagerFor(backend string, kmsClient kmsiface.KMSAPI) (KeyManager, error) {
+	switch backend {
+	case "", "softsign":
+		return newSoftsignKeyManager(), nil
+	case "kms":
+		return newAWSKMSKeyManager(kmsClient), nil
+	case "cloudkms":
+		return nil, errors.New("cloudkms KeyBackend is not implemented yet")
+	case "pkcs11":
+		return nil, errors.New("pkcs11 KeyBackend is not implemented yet")
+	case "yubikey":
+		return nil, errors.New("yubikey KeyBackend is not implemented yet")
+	default:
+		return nil, fmt.Errorf("unknown KeyBackend %q", backend)
+	}
+}
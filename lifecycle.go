@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// materialProperties changing any of these requires minting a brand new
+// secret on Update; anything else (e.g. Description) just touches metadata.
+var materialProperties = []string{"Length", "Alphabet", "KeyLength", "CAKeyName", "Attestation", "PublicKey"}
+
+func materialPropertiesChanged(oldProps, newProps map[string]interface{}) bool {
+	for _, key := range materialProperties {
+		if !reflect.DeepEqual(oldProps[key], newProps[key]) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleUpdate decides whether a CloudFormation Update needs a new secret or
+// just a metadata refresh, and always preserves the original
+// PhysicalResourceId so CloudFormation treats this as an in-place update
+// rather than a replacement.
+func (sg *secretGenerator) handleUpdate(event cfn.Event) (string, *responseSecret, error) {
+	physicalResourceID := event.PhysicalResourceID
+
+	if sg.rotateOnUpdate || materialPropertiesChanged(event.OldResourceProperties, event.ResourceProperties) {
+		_, response, err := sg.dispatch(event)
+		return physicalResourceID, response, err
+	}
+
+	err := sg.updateMetadata(event)
+	return physicalResourceID, nil, err
+}
+
+// updateMetadata rewrites an existing SSM parameter's description without
+// changing its value. Custom::KeyPair has no SSM-backed value, so there is
+// nothing to refresh. With Store "secretsmanager" the same value is written
+// again as a new secret version and the secret's description is not changed.
+func (sg *secretGenerator) updateMetadata(event cfn.Event) error {
+	if sg.validationError != nil {
+		return sg.validationError
+	}
+	if event.ResourceType == "Custom::KeyPair" {
+		return nil
+	}
+
+	description, ok := event.ResourceProperties["Description"].(string)
+	if !ok || description == "" {
+		description = defaultDescriptionFor(event.ResourceType)
+	}
+
+	name := sg.Name
+	if event.ResourceType == "Custom::SSHCertificate" {
+		name = sg.Name + "-cert.pub"
+	}
+
+	value, err := sg.secretStore().Get(name)
+	if err != nil {
+		return err
+	}
+
+	return sg.createSSMParameter(name, value, description, true)
+}
+
+func defaultDescriptionFor(resourceType string) string {
+	switch resourceType {
+	case "Custom::RSAKey":
+		return "RSA private key"
+	case "Custom::Password":
+		return "Password"
+	case "Custom::SSHCertificate":
+		return "SSH certificate"
+	default:
+		return ""
+	}
+}
+
+// handleDelete tears down whatever the ResourceType would have created,
+// tolerating the resource already being gone so a failed or partial Create
+// can still be cleaned up by CloudFormation.
+func (sg *secretGenerator) handleDelete(event cfn.Event) error {
+	if sg.validationError != nil {
+		return sg.validationError
+	}
+
+	var firstErr error
+	recordErr := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	switch event.ResourceType {
+	case "Custom::KeyPair":
+		recordErr(sg.deleteKeyPair(sg.Name))
+	case "Custom::SSHCertificate":
+		recordErr(sg.deleteSSMParameter(sg.Name))
+		recordErr(sg.deleteSSMParameter(sg.Name + "-cert.pub"))
+	default:
+		recordErr(sg.deleteSSMParameter(sg.Name))
+	}
+
+	if sg.keepHistory > 0 {
+		recordErr(sg.deleteHistory())
+	}
+	if sg.attestation != "" {
+		recordErr(sg.deleteSSMParameter(sg.Name + "-attestation"))
+	}
+
+	return firstErr
+}
+
+func (sg *secretGenerator) deleteSSMParameter(name string) error {
+	return sg.secretStore().Delete(name)
+}
+
+func (sg *secretGenerator) deleteKeyPair(name string) error {
+	req, _ := sg.EC2Client.DeleteKeyPairRequest(&ec2.DeleteKeyPairInput{
+		KeyName: aws.String(name),
+	})
+	err := req.Send()
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidKeyPair.NotFound" {
+		return nil
+	}
+	return err
+}
+
+// recordHistory keeps the last KeepHistory versions of a regenerated secret
+// under "<Name>/v<n>", with "<Name>/current" pointing at the latest one, so
+// consumers can roll back to a prior version.
+func (sg *secretGenerator) recordHistory(value string) error {
+	if sg.keepHistory <= 0 || value == "" {
+		return nil
+	}
+
+	current, err := sg.currentVersion()
+	if err != nil {
+		return err
+	}
+	next := current + 1
+	versionName := fmt.Sprintf("%s/v%d", sg.Name, next)
+
+	if err := sg.createSSMParameter(versionName, value, "Secret version", true); err != nil {
+		return err
+	}
+	if err := sg.createSSMParameter(sg.Name+"/current", versionName, "Pointer to current secret version", true); err != nil {
+		return err
+	}
+
+	if oldest := next - sg.keepHistory; oldest >= 1 {
+		return sg.deleteSSMParameter(fmt.Sprintf("%s/v%d", sg.Name, oldest))
+	}
+	return nil
+}
+
+// deleteHistory removes every "<Name>/v<n>" parameter recordHistory may have
+// retained, plus the "<Name>/current" pointer, so Delete doesn't leak the
+// very parameters KeepHistory set out to manage.
+func (sg *secretGenerator) deleteHistory() error {
+	current, err := sg.currentVersion()
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for v := current; v >= 1 && v > current-sg.keepHistory; v-- {
+		if err := sg.deleteSSMParameter(fmt.Sprintf("%s/v%d", sg.Name, v)); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := sg.deleteSSMParameter(sg.Name + "/current"); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+func (sg *secretGenerator) currentVersion() (int, error) {
+	pointer, err := sg.secretStore().Get(sg.Name + "/current")
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && (awsErr.Code() == ssm.ErrCodeParameterNotFound || awsErr.Code() == secretsmanager.ErrCodeResourceNotFoundException) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(pointer, sg.Name+"/v%d", &version); err != nil {
+		return 0, nil
+	}
+	return version, nil
+}
+
+// secretValueFrom extracts the regenerated secret value from a handler's
+// response, whichever field it landed in, for history snapshotting.
+func secretValueFrom(response *responseSecret) string {
+	if response == nil {
+		return ""
+	}
+	switch {
+	case response.Password != nil:
+		return *response.Password
+	case response.PrivateKey != nil:
+		return *response.PrivateKey
+	case response.KeyRef != nil:
+		return *response.KeyRef
+	case response.Certificate != nil:
+		return *response.Certificate
+	}
+	return ""
+}
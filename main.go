@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/aws/aws-lambda-go/cfn"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
 	"github.com/aws/aws-sdk-go/service/ssm"
 )
 
@@ -15,6 +18,8 @@ var (
 	ses       *session.Session
 	ec2Client *ec2.EC2
 	ssmClient *ssm.SSM
+	kmsClient *kms.KMS
+	smClient  *secretsmanager.SecretsManager
 )
 
 func init() {
@@ -23,10 +28,37 @@ func init() {
 	}))
 	ec2Client = ec2.New(ses)
 	ssmClient = ssm.New(ses)
+	kmsClient = kms.New(ses)
+	smClient = secretsmanager.New(ses)
 }
 
 func handler(ctx context.Context, event cfn.Event) (physicalResourceID string, data map[string]interface{}, err error) {
-	return newSecret(ec2Client, ssmClient).Process(event)
+	return newSecret(ec2Client, ssmClient, kmsClient, smClient).Process(event)
+}
+
+func rotationHandler(ctx context.Context, event secretsManagerRotationEvent) error {
+	return newSecret(ec2Client, ssmClient, kmsClient, smClient).handleRotation(event)
+}
+
+// dualModeHandler lets a single Lambda serve both as the CloudFormation
+// custom resource provider and, when deployed as a Secrets Manager rotation
+// Lambda, as the rotation handler: the two event shapes are distinguished by
+// the presence of a "Step" field.
+func dualModeHandler(ctx context.Context, raw json.RawMessage) (json.RawMessage, error) {
+	var probe secretsManagerRotationEvent
+	if err := json.Unmarshal(raw, &probe); err == nil && isSecretsManagerRotationEvent(probe) {
+		return nil, rotationHandler(ctx, probe)
+	}
+
+	var event cfn.Event
+	if err := json.Unmarshal(raw, &event); err != nil {
+		return nil, err
+	}
+	reason, err := cfn.LambdaWrap(handler)(ctx, event)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(reason)
 }
 
 func main() {
@@ -52,5 +84,5 @@ func main() {
 		}
 		fmt.Print(resp["Response"])
 	}
-	lambda.Start(cfn.LambdaWrap(handler))
+	lambda.Start(dualModeHandler)
 }
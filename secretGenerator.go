@@ -5,6 +5,8 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"errors"
+	"fmt"
+	"time"
 
 	"encoding/pem"
 
@@ -12,39 +14,74 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
-	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 	"golang.org/x/crypto/ssh"
 )
 
+// defaultAlphabet is used for generated passwords when the caller does not
+// supply one, both for Custom::Password and for Secrets Manager rotations.
+const defaultAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz!@#$%^&*()_+-[]?;,."
+
 type secretGenerator struct {
-	EC2Client       ec2iface.EC2API
-	SSMClient       ssmiface.SSMAPI
-	Name            string
-	publicKey       *string
-	alphabet        string
-	passwordLength  int
-	validationError error
+	EC2Client            ec2iface.EC2API
+	SSMClient            ssmiface.SSMAPI
+	KMSClient            kmsiface.KMSAPI
+	SecretsManagerClient secretsmanageriface.SecretsManagerAPI
+	Name                 string
+	publicKey            *string
+	alphabet             string
+	passwordLength       int
+	keyBackend           string
+	keyManager           KeyManager
+	caKeyName            string
+	certType             string
+	keyID                string
+	principals           []string
+	criticalOptions      map[string]string
+	extensions           map[string]string
+	validAfter           uint64
+	validBefore          uint64
+	keyLength            int
+	rotateOnUpdate       bool
+	keepHistory          int
+	isUpdate             bool
+	store                SecretStore
+	rotationLambdaARN    string
+	rotationDays         int64
+	attestation          string
+	attestationKeyHandle string
+	validationError      error
 }
 
 type responseSecret struct {
-	KeyLength  *int    `json:"key_length"`
-	PrivateKey *string `json:"private_key"`
-	PublicKey  *string `json:"public_key"`
-	Password   *string `json:"password"`
+	KeyLength   *int    `json:"key_length"`
+	PrivateKey  *string `json:"private_key"`
+	PublicKey   *string `json:"public_key"`
+	Password    *string `json:"password"`
+	KeyRef      *string `json:"key_ref"`
+	Certificate *string `json:"certificate"`
+
+	Attestation       *string `json:"attestation"`
+	AttestationFormat *string `json:"attestation_format"`
 }
 
-func newSecret(ec2Client ec2iface.EC2API, ssmClient ssmiface.SSMAPI) *secretGenerator {
+func newSecret(ec2Client ec2iface.EC2API, ssmClient ssmiface.SSMAPI, kmsClient kmsiface.KMSAPI, smClient secretsmanageriface.SecretsManagerAPI) *secretGenerator {
 	return &secretGenerator{
-		EC2Client: ec2Client,
-		SSMClient: ssmClient,
+		EC2Client:            ec2Client,
+		SSMClient:            ssmClient,
+		KMSClient:            kmsClient,
+		SecretsManagerClient: smClient,
 	}
 }
 
 func (sg *secretGenerator) validateEvent(event cfn.Event) *secretGenerator {
 	trg := &secretGenerator{
-		SSMClient: sg.SSMClient,
-		EC2Client: sg.EC2Client}
+		SSMClient:            sg.SSMClient,
+		EC2Client:            sg.EC2Client,
+		KMSClient:            sg.KMSClient,
+		SecretsManagerClient: sg.SecretsManagerClient}
 	keyName, ok := event.ResourceProperties["Name"].(string)
 	if !ok {
 		trg.validationError = errors.New("Missing required property 'Name'")
@@ -57,7 +94,7 @@ func (sg *secretGenerator) validateEvent(event cfn.Event) *secretGenerator {
 	}
 	alphabet, ok := event.ResourceProperties["Alphabet"].(string)
 	if !ok {
-		alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz!@#$%^&*()_+-[]?;,."
+		alphabet = defaultAlphabet
 	}
 	trg.alphabet = alphabet
 	length, ok := event.ResourceProperties["Length"].(int)
@@ -66,15 +103,135 @@ func (sg *secretGenerator) validateEvent(event cfn.Event) *secretGenerator {
 	}
 	trg.passwordLength = length
 
+	keyBackend, _ := event.ResourceProperties["KeyBackend"].(string)
+	trg.keyBackend = keyBackend
+	keyManager, err := keyManagerFor(keyBackend, trg.KMSClient)
+	if err != nil {
+		trg.validationError = err
+	}
+	trg.keyManager = keyManager
+
+	caKeyName, _ := event.ResourceProperties["CAKeyName"].(string)
+	trg.caKeyName = caKeyName
+	certType, ok := event.ResourceProperties["CertType"].(string)
+	if !ok || certType == "" {
+		certType = "user"
+	}
+	trg.certType = certType
+	keyID, _ := event.ResourceProperties["KeyId"].(string)
+	trg.keyID = keyID
+
+	principals, err := parseStringSlice(event.ResourceProperties["Principals"])
+	if err != nil {
+		trg.validationError = fmt.Errorf("parsing Principals: %w", err)
+	}
+	trg.principals = principals
+
+	criticalOptions, err := parseStringMap(event.ResourceProperties["CriticalOptions"])
+	if err != nil {
+		trg.validationError = fmt.Errorf("parsing CriticalOptions: %w", err)
+	}
+	trg.criticalOptions = criticalOptions
+	extensions, err := parseStringMap(event.ResourceProperties["Extensions"])
+	if err != nil {
+		trg.validationError = fmt.Errorf("parsing Extensions: %w", err)
+	}
+	if extensions == nil && certType == "user" {
+		extensions = defaultUserExtensions
+	}
+	trg.extensions = extensions
+
+	now := time.Now()
+	validAfter, err := parseCertTime(event.ResourceProperties["ValidAfter"], now, now)
+	if err != nil {
+		trg.validationError = fmt.Errorf("parsing ValidAfter: %w", err)
+	}
+	trg.validAfter = validAfter
+	validBefore, err := parseCertTime(event.ResourceProperties["ValidBefore"], now, now.Add(time.Hour))
+	if err != nil {
+		trg.validationError = fmt.Errorf("parsing ValidBefore: %w", err)
+	}
+	trg.validBefore = validBefore
+
+	keyLength, ok := event.ResourceProperties["KeyLength"].(int)
+	if !ok {
+		keyLength = 2048
+	}
+	trg.keyLength = keyLength
+
+	rotateOnUpdate, _ := event.ResourceProperties["RotateOnUpdate"].(bool)
+	trg.rotateOnUpdate = rotateOnUpdate
+	keepHistory, _ := event.ResourceProperties["KeepHistory"].(int)
+	trg.keepHistory = keepHistory
+	trg.isUpdate = event.RequestType == cfn.RequestUpdate
+
+	rotationLambdaARN, _ := event.ResourceProperties["RotationLambdaARN"].(string)
+	trg.rotationLambdaARN = rotationLambdaARN
+	if rotationDays, ok := event.ResourceProperties["RotationDays"].(int); ok {
+		trg.rotationDays = int64(rotationDays)
+	}
+	storeKind, _ := event.ResourceProperties["Store"].(string)
+	store, err := secretStoreFor(storeKind, trg.SSMClient, trg.SecretsManagerClient, rotationLambdaARN, trg.rotationDays)
+	if err != nil {
+		trg.validationError = err
+	}
+	trg.store = store
+
+	attestation, _ := event.ResourceProperties["Attestation"].(string)
+	trg.attestation = attestation
+	attestationKeyHandle, _ := event.ResourceProperties["AttestationKeyHandle"].(string)
+	trg.attestationKeyHandle = attestationKeyHandle
+
 	return trg
 }
 
+// secretStore returns sg.store, falling back to a plain Parameter Store
+// implementation for callers (and tests) that construct a secretGenerator
+// directly without going through validateEvent.
+func (sg *secretGenerator) secretStore() SecretStore {
+	if sg.store != nil {
+		return sg.store
+	}
+	return newSSMStore(sg.SSMClient)
+}
+
 func (sg *secretGenerator) Process(event cfn.Event) (physicalResourceID string, data map[string]interface{}, err error) {
 	sg = sg.validateEvent(event)
 	data = map[string]interface{}{
 		"Response": nil,
 	}
 	var response *responseSecret
+
+	switch event.RequestType {
+	case cfn.RequestDelete:
+		physicalResourceID = event.PhysicalResourceID
+		err = sg.handleDelete(event)
+
+	case cfn.RequestUpdate:
+		physicalResourceID, response, err = sg.handleUpdate(event)
+		if err == nil {
+			err = sg.recordHistory(secretValueFrom(response))
+		}
+
+	default:
+		physicalResourceID, response, err = sg.dispatch(event)
+		if err == nil {
+			err = sg.recordHistory(secretValueFrom(response))
+		}
+	}
+
+	if response != nil {
+		data = map[string]interface{}{
+			"Response": *response,
+		}
+	}
+
+	return
+}
+
+// dispatch routes a Create (or plain, RequestType-less) event to the handler
+// for its ResourceType.
+func (sg *secretGenerator) dispatch(event cfn.Event) (physicalResourceID string, response *responseSecret, err error) {
 	switch event.ResourceType {
 	case "Custom::RSAKey":
 		response, err = sg.handleRSAKey()
@@ -87,17 +244,15 @@ func (sg *secretGenerator) Process(event cfn.Event) (physicalResourceID string,
 		response, err = sg.handlePassword()
 		physicalResourceID = "Password:" + sg.Name
 
+	case "Custom::SSHCertificate":
+		response, err = sg.handleSSHCertificate()
+		physicalResourceID = "SSHCertificate:" + sg.Name
+
 	default:
 		err = errors.New("Unknown ResourceType")
 		physicalResourceID = "Unknown:" + sg.Name
 	}
 
-	if response != nil {
-		data = map[string]interface{}{
-			"Response": *response,
-		}
-	}
-
 	return
 }
 
@@ -106,7 +261,23 @@ func (sg *secretGenerator) handleRSAKey() (*responseSecret, error) {
 	if sg.validationError != nil {
 		return nil, sg.validationError
 	}
-	keyLength := 2048
+	keyLength := sg.keyLength
+
+	// Attestation takes priority over KeyBackend: the key is generated
+	// inside the attestable environment itself rather than through
+	// sg.keyManager, and the response carries the attestation document
+	// alongside the public key.
+	if sg.attestation != "" {
+		return sg.handleAttestedRSAKey()
+	}
+
+	// softsign is the only backend that hands back a private key the caller
+	// can PEM-encode; KMS-backed (and future HSM-backed) keys never leave
+	// their hardware, so we only ever learn their public half and a
+	// reference to the key.
+	if _, ok := sg.keyManager.(*softsignKeyManager); !ok {
+		return sg.handleHSMBackedRSAKey()
+	}
 
 	privateKey, err := rsa.GenerateKey(rand.Reader, keyLength)
 	if err != nil {
@@ -135,7 +306,7 @@ func (sg *secretGenerator) handleRSAKey() (*responseSecret, error) {
 	resPrivateKey := string(privatePEM)
 	resPublicKey := string(publicKey)
 
-	err = sg.createSSMParameter(sg.Name, resPrivateKey, "RSA private key", false)
+	err = sg.createSSMParameter(sg.Name, resPrivateKey, "RSA private key", sg.isUpdate)
 
 	return &responseSecret{
 		KeyLength:  &keyLength,
@@ -143,6 +314,96 @@ func (sg *secretGenerator) handleRSAKey() (*responseSecret, error) {
 		PublicKey:  &resPublicKey}, err
 }
 
+// handleHSMBackedRSAKey creates the key through sg.keyManager so that the
+// private key is generated and held inside the KMS/HSM backend. Only the
+// public key and a reference to the backend key are ever written to SSM.
+func (sg *secretGenerator) handleHSMBackedRSAKey() (*responseSecret, error) {
+	keyLength := sg.keyLength
+	algorithm := "RSA_2048"
+	if keyLength == 4096 {
+		algorithm = "RSA_4096"
+	}
+
+	name, pub, _, err := sg.keyManager.CreateKey(KeySpec{Name: sg.Name, Algorithm: algorithm})
+	if err != nil {
+		return nil, err
+	}
+
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("KeyManager returned a non-RSA public key")
+	}
+	publicKeySSH, err := ssh.NewPublicKey(rsaPub)
+	if err != nil {
+		return nil, err
+	}
+	resPublicKey := string(ssh.MarshalAuthorizedKey(publicKeySSH))
+
+	keyRef := keyRefFor(sg.keyBackend, name)
+
+	err = sg.createSSMParameter(sg.Name, keyRef, "KMS key reference", sg.isUpdate)
+
+	return &responseSecret{
+		KeyLength: &keyLength,
+		PublicKey: &resPublicKey,
+		KeyRef:    &keyRef}, err
+}
+
+// handleAttestedRSAKey generates the key inside the attestable environment
+// named by the "Attestation" property (nitro or tpm) and stores the
+// resulting attestation document as a sibling "<Name>-attestation" SSM
+// parameter, so a relying party can verify the private key never existed
+// outside the enclave/TPM before trusting the corresponding certificate.
+// The private key itself is never returned: it never leaves the attester.
+func (sg *secretGenerator) handleAttestedRSAKey() (*responseSecret, error) {
+	keyLength := sg.keyLength
+	algorithm := "RSA_2048"
+	if keyLength == 4096 {
+		algorithm = "RSA_4096"
+	}
+
+	attester, err := attesterFor(sg.attestation, sg.attestationKeyHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, _, attestation, format, err := attester.GenerateAttestedKey(KeySpec{Name: sg.Name, Algorithm: algorithm})
+	if err != nil {
+		return nil, err
+	}
+
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Attester returned a non-RSA public key")
+	}
+	publicKeySSH, err := ssh.NewPublicKey(rsaPub)
+	if err != nil {
+		return nil, err
+	}
+	resPublicKey := string(ssh.MarshalAuthorizedKey(publicKeySSH))
+	resAttestation := string(attestation)
+
+	if err := sg.createSSMParameter(sg.Name+"-attestation", resAttestation, "Attestation document", sg.isUpdate); err != nil {
+		return nil, err
+	}
+
+	return &responseSecret{
+		KeyLength:         &keyLength,
+		PublicKey:         &resPublicKey,
+		Attestation:       &resAttestation,
+		AttestationFormat: &format}, nil
+}
+
+// keyRefFor builds the URI-style key reference returned to CloudFormation,
+// e.g. "awskms:key-id=1234abcd-...".
+func keyRefFor(backend, name string) string {
+	scheme := backend
+	if scheme == "kms" {
+		scheme = "awskms"
+	}
+	return fmt.Sprintf("%s:key-id=%s", scheme, name)
+}
+
 func (sg *secretGenerator) handleKeyPair() error {
 
 	if sg.validationError != nil {
@@ -153,6 +414,12 @@ func (sg *secretGenerator) handleKeyPair() error {
 		return sg.validationError
 	}
 
+	if sg.isUpdate {
+		if err := sg.deleteKeyPair(sg.Name); err != nil {
+			return err
+		}
+	}
+
 	req, _ := sg.EC2Client.ImportKeyPairRequest(&ec2.ImportKeyPairInput{
 		KeyName:           aws.String(sg.Name),
 		PublicKeyMaterial: []byte(*sg.publicKey),
@@ -164,32 +431,33 @@ func (sg *secretGenerator) handlePassword() (*responseSecret, error) {
 	if sg.validationError != nil {
 		return nil, sg.validationError
 	}
-	buff := make([]byte, sg.passwordLength)
-	_, err := rand.Read(buff)
+	password, err := generateRandomPassword(sg.passwordLength, sg.alphabet)
 	if err != nil {
 		return nil, err
 	}
-	l := len(sg.alphabet)
-	for i, b := range buff {
-		buff[i] = sg.alphabet[b%byte(l)]
-	}
-	password := string(buff)
 
-	err = sg.createSSMParameter(sg.Name, password, "Password", false)
+	err = sg.createSSMParameter(sg.Name, password, "Password", sg.isUpdate)
 
 	return &responseSecret{Password: &password}, err
 }
 
+// generateRandomPassword draws passwordLength random bytes and maps each one
+// onto alphabet, the same way handlePassword always has.
+func generateRandomPassword(passwordLength int, alphabet string) (string, error) {
+	buff := make([]byte, passwordLength)
+	if _, err := rand.Read(buff); err != nil {
+		return "", err
+	}
+	l := len(alphabet)
+	for i, b := range buff {
+		buff[i] = alphabet[b%byte(l)]
+	}
+	return string(buff), nil
+}
+
 func (sg *secretGenerator) createSSMParameter(key, value, description string, override bool) error {
 	if sg.validationError != nil {
 		return sg.validationError
 	}
-	req, _ := sg.SSMClient.PutParameterRequest(&ssm.PutParameterInput{
-		Description: aws.String(description),
-		Name:        aws.String(key),
-		Type:        aws.String(ssm.ParameterTypeSecureString),
-		Value:       aws.String(value),
-		Overwrite:   aws.Bool(override),
-	})
-	return req.Send()
+	return sg.secretStore().Put(key, value, description, override)
 }
@@ -6,10 +6,13 @@ import (
 	"testing"
 
 	"github.com/aws/aws-lambda-go/cfn"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
 )
@@ -17,7 +20,11 @@ import (
 var (
 	failToImportKeyPair = "FAIL_TO_IMPORT"
 	failToCreateParam   = "FAIL_TO_CREATE"
+	failToDeleteKeyPair = "FAIL_TO_DELETE_KEYPAIR"
+	failToDeleteParam   = "FAIL_TO_DELETE_PARAM"
 	awsError            = awserr.New("error code", "error message", nil)
+	parameterNotFound   = awserr.New(ssm.ErrCodeParameterNotFound, "not found", nil)
+	keyPairNotFound     = awserr.New("InvalidKeyPair.NotFound", "not found", nil)
 )
 
 type mockEC2Client struct {
@@ -37,10 +44,38 @@ func (m *mockEC2Client) ImportKeyPairRequest(input *ec2.ImportKeyPairInput) (*re
 	}, &ec2.ImportKeyPairOutput{}
 }
 
+func (m *mockEC2Client) DeleteKeyPairRequest(input *ec2.DeleteKeyPairInput) (*request.Request, *ec2.DeleteKeyPairOutput) {
+	var err awserr.Error
+
+	switch *input.KeyName {
+	case failToDeleteKeyPair:
+		err = awsError
+	case "NEVER_EXISTED":
+		err = keyPairNotFound
+	}
+	return &request.Request{
+		Data:        &ec2.DeleteKeyPairOutput{},
+		HTTPRequest: &http.Request{Host: "localhost"},
+		Error:       err,
+	}, &ec2.DeleteKeyPairOutput{}
+}
+
 type mockSSMClient struct {
 	ssmiface.SSMAPI
 }
 
+// mockKMSClient is unused by the softsign-backed tests below; it exists so
+// newSecret can be constructed without a real AWS session.
+type mockKMSClient struct {
+	kmsiface.KMSAPI
+}
+
+// mockSecretsManagerClient is unused by the SSM-backed tests below; it exists
+// so newSecret can be constructed without a real AWS session.
+type mockSecretsManagerClient struct {
+	secretsmanageriface.SecretsManagerAPI
+}
+
 func (m *mockSSMClient) PutParameterRequest(input *ssm.PutParameterInput) (*request.Request, *ssm.PutParameterOutput) {
 	var err awserr.Error
 	if *input.Name == failToCreateParam {
@@ -53,9 +88,41 @@ func (m *mockSSMClient) PutParameterRequest(input *ssm.PutParameterInput) (*requ
 	}, &ssm.PutParameterOutput{}
 }
 
+func (m *mockSSMClient) DeleteParameterRequest(input *ssm.DeleteParameterInput) (*request.Request, *ssm.DeleteParameterOutput) {
+	var err awserr.Error
+	switch *input.Name {
+	case failToDeleteParam:
+		err = awsError
+	case "NEVER_EXISTED":
+		err = parameterNotFound
+	}
+	return &request.Request{
+		Data:        &ssm.DeleteParameterOutput{},
+		HTTPRequest: &http.Request{Host: "localhost"},
+		Error:       err,
+	}, &ssm.DeleteParameterOutput{}
+}
+
+func (m *mockSSMClient) GetParameterRequest(input *ssm.GetParameterInput) (*request.Request, *ssm.GetParameterOutput) {
+	var err awserr.Error
+	if *input.Name == "MISSING_PARAM" {
+		err = parameterNotFound
+	}
+	return &request.Request{
+		Data: &ssm.GetParameterOutput{
+			Parameter: &ssm.Parameter{
+				Name:  input.Name,
+				Value: aws.String("existing-value"),
+			},
+		},
+		HTTPRequest: &http.Request{Host: "localhost"},
+		Error:       err,
+	}, &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Name: input.Name, Value: aws.String("existing-value")}}
+}
+
 // TestCreateSSMParameter ...
 func TestCreateSSMParameter(t *testing.T) {
-	sg := newSecret(&mockEC2Client{}, &mockSSMClient{})
+	sg := newSecret(&mockEC2Client{}, &mockSSMClient{}, &mockKMSClient{}, &mockSecretsManagerClient{})
 
 	t.Run("Test createSSMParameter->Successful", func(t *testing.T) {
 		err := sg.createSSMParameter("KeyName", "some secret", "secret description", false)
@@ -88,7 +155,7 @@ func TestCreateSSMParameter(t *testing.T) {
 
 // TestHandleKeyPair ...
 func TestHandleKeyPair(t *testing.T) {
-	sg := newSecret(&mockEC2Client{}, &mockSSMClient{})
+	sg := newSecret(&mockEC2Client{}, &mockSSMClient{}, &mockKMSClient{}, &mockSecretsManagerClient{})
 
 	t.Run("Test handleKeyPair->Successful", func(t *testing.T) {
 		event := cfn.Event{
@@ -147,7 +214,7 @@ func TestHandleKeyPair(t *testing.T) {
 
 //TestHandlePassword ...
 func TestHandlePassword(t *testing.T) {
-	sg := newSecret(&mockEC2Client{}, &mockSSMClient{})
+	sg := newSecret(&mockEC2Client{}, &mockSSMClient{}, &mockKMSClient{}, &mockSecretsManagerClient{})
 
 	t.Run("Test handlePassword->Successful", func(t *testing.T) {
 		event := cfn.Event{
@@ -194,7 +261,7 @@ func TestHandlePassword(t *testing.T) {
 
 //TestHandleRSAKey ...
 func TestHandleRSAKey(t *testing.T) {
-	sg := newSecret(&mockEC2Client{}, &mockSSMClient{})
+	sg := newSecret(&mockEC2Client{}, &mockSSMClient{}, &mockKMSClient{}, &mockSecretsManagerClient{})
 
 	t.Run("Test handleRSAKey->Successful", func(t *testing.T) {
 
@@ -247,7 +314,7 @@ func TestHandleRSAKey(t *testing.T) {
 
 //TestProcess ...
 func TestProcess(t *testing.T) {
-	sg := newSecret(&mockEC2Client{}, &mockSSMClient{})
+	sg := newSecret(&mockEC2Client{}, &mockSSMClient{}, &mockKMSClient{}, &mockSecretsManagerClient{})
 
 	t.Run("TestProcessRSAKey->Successfully", func(t *testing.T) {
 		event := cfn.Event{
@@ -331,3 +398,119 @@ func TestProcess(t *testing.T) {
 	})
 
 }
+
+// TestProcessDelete ...
+func TestProcessDelete(t *testing.T) {
+	sg := newSecret(&mockEC2Client{}, &mockSSMClient{}, &mockKMSClient{}, &mockSecretsManagerClient{})
+
+	t.Run("TestProcessDelete->Password", func(t *testing.T) {
+		event := cfn.Event{
+			RequestType:        cfn.RequestDelete,
+			PhysicalResourceID: "Password:OLD_PASSWORD",
+			ResourceType:       "Custom::Password",
+			ResourceProperties: map[string]interface{}{"Name": "OLD_PASSWORD"}}
+		id, _, err := sg.Process(event)
+		if err != nil {
+			t.Error("Error : " + err.Error())
+		}
+		if id != "Password:OLD_PASSWORD" {
+			t.Error("The physical resource id should be preserved on delete")
+		}
+	})
+
+	t.Run("TestProcessDelete->KeyPair", func(t *testing.T) {
+		event := cfn.Event{
+			RequestType:        cfn.RequestDelete,
+			PhysicalResourceID: "KeyPair:OLD_KEY",
+			ResourceType:       "Custom::KeyPair",
+			ResourceProperties: map[string]interface{}{"Name": "OLD_KEY"}}
+		_, _, err := sg.Process(event)
+		if err != nil {
+			t.Error("Error : " + err.Error())
+		}
+	})
+
+	t.Run("TestProcessDelete->AlreadyGone", func(t *testing.T) {
+		event := cfn.Event{
+			RequestType:        cfn.RequestDelete,
+			PhysicalResourceID: "Password:NEVER_EXISTED",
+			ResourceType:       "Custom::Password",
+			ResourceProperties: map[string]interface{}{"Name": "NEVER_EXISTED"}}
+		_, _, err := sg.Process(event)
+		if err != nil {
+			t.Error("Deleting an already-gone parameter should not error : " + err.Error())
+		}
+	})
+
+	t.Run("TestProcessDelete->Failure", func(t *testing.T) {
+		event := cfn.Event{
+			RequestType:        cfn.RequestDelete,
+			PhysicalResourceID: "Password:" + failToDeleteParam,
+			ResourceType:       "Custom::Password",
+			ResourceProperties: map[string]interface{}{"Name": failToDeleteParam}}
+		_, _, err := sg.Process(event)
+		if err == nil {
+			t.Error("Error expected")
+		}
+	})
+}
+
+// TestProcessUpdate ...
+func TestProcessUpdate(t *testing.T) {
+	sg := newSecret(&mockEC2Client{}, &mockSSMClient{}, &mockKMSClient{}, &mockSecretsManagerClient{})
+
+	t.Run("TestProcessUpdate->MetadataOnly", func(t *testing.T) {
+		event := cfn.Event{
+			RequestType:           cfn.RequestUpdate,
+			PhysicalResourceID:    "Password:MY_PASSWORD",
+			ResourceType:          "Custom::Password",
+			ResourceProperties:    map[string]interface{}{"Name": "MY_PASSWORD", "Description": "updated description"},
+			OldResourceProperties: map[string]interface{}{"Name": "MY_PASSWORD"}}
+		id, resp, err := sg.Process(event)
+		if err != nil {
+			t.Error("Error : " + err.Error())
+		}
+		if id != "Password:MY_PASSWORD" {
+			t.Error("The physical resource id should be preserved on update")
+		}
+		if resp["Response"] != nil {
+			t.Error("A metadata-only update should not mint a new secret")
+		}
+	})
+
+	t.Run("TestProcessUpdate->MaterialChangeRegenerates", func(t *testing.T) {
+		event := cfn.Event{
+			RequestType:           cfn.RequestUpdate,
+			PhysicalResourceID:    "Password:MY_PASSWORD",
+			ResourceType:          "Custom::Password",
+			ResourceProperties:    map[string]interface{}{"Name": "MY_PASSWORD", "Length": 40},
+			OldResourceProperties: map[string]interface{}{"Name": "MY_PASSWORD", "Length": 30}}
+		id, resp, err := sg.Process(event)
+		if err != nil {
+			t.Error("Error : " + err.Error())
+		}
+		if id != "Password:MY_PASSWORD" {
+			t.Error("The physical resource id should be preserved on update")
+		}
+		data, ok := resp["Response"].(responseSecret)
+		if !ok || data.Password == nil {
+			t.Error("A material property change should mint a new secret")
+		}
+	})
+
+	t.Run("TestProcessUpdate->RotateOnUpdate", func(t *testing.T) {
+		event := cfn.Event{
+			RequestType:           cfn.RequestUpdate,
+			PhysicalResourceID:    "Password:MY_PASSWORD",
+			ResourceType:          "Custom::Password",
+			ResourceProperties:    map[string]interface{}{"Name": "MY_PASSWORD", "RotateOnUpdate": true},
+			OldResourceProperties: map[string]interface{}{"Name": "MY_PASSWORD"}}
+		_, resp, err := sg.Process(event)
+		if err != nil {
+			t.Error("Error : " + err.Error())
+		}
+		if _, ok := resp["Response"].(responseSecret); !ok {
+			t.Error("RotateOnUpdate should mint a new secret even without a material property change")
+		}
+	})
+}
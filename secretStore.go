@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// SecretStore abstracts over where a secret's value actually lives, so a
+// resource can choose Parameter Store (the default, back-compat behavior)
+// or Secrets Manager (for native rotation-Lambda support) per-resource via
+// the "Store" ResourceProperty.
+type SecretStore interface {
+	Put(name, value, description string, overwrite bool) error
+	Get(name string) (string, error)
+	Delete(name string) error
+}
+
+type ssmStore struct {
+	Client ssmiface.SSMAPI
+}
+
+func newSSMStore(client ssmiface.SSMAPI) *ssmStore {
+	return &ssmStore{Client: client}
+}
+
+func (s *ssmStore) Put(name, value, description string, overwrite bool) error {
+	req, _ := s.Client.PutParameterRequest(&ssm.PutParameterInput{
+		Description: aws.String(description),
+		Name:        aws.String(name),
+		Type:        aws.String(ssm.ParameterTypeSecureString),
+		Value:       aws.String(value),
+		Overwrite:   aws.Bool(overwrite),
+	})
+	return req.Send()
+}
+
+func (s *ssmStore) Get(name string) (string, error) {
+	req, out := s.Client.GetParameterRequest(&ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err := req.Send(); err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.Parameter.Value), nil
+}
+
+func (s *ssmStore) Delete(name string) error {
+	req, _ := s.Client.DeleteParameterRequest(&ssm.DeleteParameterInput{Name: aws.String(name)})
+	err := req.Send()
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == ssm.ErrCodeParameterNotFound {
+		return nil
+	}
+	return err
+}
+
+// secretsManagerStore persists values in AWS Secrets Manager. When a
+// RotationLambdaARN is configured it also registers the secret for native
+// rotation on every Put, so provisioning and ongoing rotation are covered
+// by the same deployment.
+type secretsManagerStore struct {
+	Client            secretsmanageriface.SecretsManagerAPI
+	RotationLambdaARN string
+	RotationDays      int64
+}
+
+func newSecretsManagerStore(client secretsmanageriface.SecretsManagerAPI, rotationLambdaARN string, rotationDays int64) *secretsManagerStore {
+	return &secretsManagerStore{Client: client, RotationLambdaARN: rotationLambdaARN, RotationDays: rotationDays}
+}
+
+func (s *secretsManagerStore) Put(name, value, description string, overwrite bool) error {
+	createReq, _ := s.Client.CreateSecretRequest(&secretsmanager.CreateSecretInput{
+		Name:         aws.String(name),
+		Description:  aws.String(description),
+		SecretString: aws.String(value),
+	})
+	err := createReq.Send()
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == secretsmanager.ErrCodeResourceExistsException {
+		if !overwrite {
+			return err
+		}
+		putReq, _ := s.Client.PutSecretValueRequest(&secretsmanager.PutSecretValueInput{
+			SecretId:     aws.String(name),
+			SecretString: aws.String(value),
+		})
+		err = putReq.Send()
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.RotationLambdaARN == "" {
+		return nil
+	}
+
+	rotateReq, _ := s.Client.RotateSecretRequest(&secretsmanager.RotateSecretInput{
+		SecretId:          aws.String(name),
+		RotationLambdaARN: aws.String(s.RotationLambdaARN),
+		RotationRules: &secretsmanager.RotationRulesType{
+			AutomaticallyAfterDays: aws.Int64(s.rotationDaysOrDefault()),
+		},
+	})
+	return rotateReq.Send()
+}
+
+func (s *secretsManagerStore) rotationDaysOrDefault() int64 {
+	if s.RotationDays > 0 {
+		return s.RotationDays
+	}
+	return 30
+}
+
+func (s *secretsManagerStore) Get(name string) (string, error) {
+	req, out := s.Client.GetSecretValueRequest(&secretsmanager.GetSecretValueInput{SecretId: aws.String(name)})
+	if err := req.Send(); err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.SecretString), nil
+}
+
+func (s *secretsManagerStore) Delete(name string) error {
+	req, _ := s.Client.DeleteSecretRequest(&secretsmanager.DeleteSecretInput{
+		SecretId:                   aws.String(name),
+		ForceDeleteWithoutRecovery: aws.Bool(true),
+	})
+	err := req.Send()
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+		return nil
+	}
+	return err
+}
+
+// secretStoreFor selects a SecretStore for the given "Store" ResourceProperty
+// value, defaulting to Parameter Store so existing stacks are unaffected.
+func secretStoreFor(kind string, ssmClient ssmiface.SSMAPI, smClient secretsmanageriface.SecretsManagerAPI, rotationLambdaARN string, rotationDays int64) (SecretStore, error) {
+	switch kind {
+	case "", "ssm":
+		return newSSMStore(ssmClient), nil
+	case "secretsmanager":
+		return newSecretsManagerStore(smClient, rotationLambdaARN, rotationDays), nil
+	default:
+		return nil, fmt.Errorf("unknown Store %q", kind)
+	}
+}
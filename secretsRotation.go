@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// secretsManagerRotationEvent is the event Secrets Manager sends to a
+// rotation Lambda, as distinct from the cfn.Event this Lambda otherwise
+// handles. See:
+// https://docs.aws.amazon.com/secretsmanager/latest/userguide/rotate-secrets_lambda-function-overview.html
+type secretsManagerRotationEvent struct {
+	Step               string `json:"Step"`
+	SecretId           string `json:"SecretId"`
+	ClientRequestToken string `json:"ClientRequestToken"`
+}
+
+// isSecretsManagerRotationEvent reports whether event looks like a Secrets
+// Manager rotation event rather than a CloudFormation custom resource event,
+// so main can dispatch to the right handler.
+func isSecretsManagerRotationEvent(event secretsManagerRotationEvent) bool {
+	return event.Step != ""
+}
+
+// handleRotation implements the four-step Secrets Manager rotation contract
+// for secrets this Lambda provisioned: generate a new AWSPENDING version,
+// set it (a no-op here, since secrethelper only manages the value itself),
+// test it (also a no-op), then promote AWSPENDING to AWSCURRENT.
+func (sg *secretGenerator) handleRotation(event secretsManagerRotationEvent) error {
+	switch event.Step {
+	case "createSecret":
+		return sg.rotationCreateSecret(event)
+	case "setSecret":
+		return nil
+	case "testSecret":
+		return nil
+	case "finishSecret":
+		return sg.rotationFinishSecret(event)
+	default:
+		return fmt.Errorf("unknown rotation step %q", event.Step)
+	}
+}
+
+func (sg *secretGenerator) rotationCreateSecret(event secretsManagerRotationEvent) error {
+	if _, err := sg.getSecretVersion(event.SecretId, event.ClientRequestToken, ""); err == nil {
+		// A pending version already exists for this request token.
+		return nil
+	}
+
+	current, err := sg.getSecretVersion(event.SecretId, "", "AWSCURRENT")
+	if err != nil {
+		return err
+	}
+
+	if !isRotatablePassword(current) {
+		return fmt.Errorf("secret %q does not hold a Custom::Password value; Secrets Manager rotation is not supported for RSA keys, key references or certificates", event.SecretId)
+	}
+
+	newValue, err := generateRandomPassword(len(current), defaultAlphabet)
+	if err != nil {
+		return err
+	}
+
+	req, _ := sg.SecretsManagerClient.PutSecretValueRequest(&secretsmanager.PutSecretValueInput{
+		SecretId:           aws.String(event.SecretId),
+		ClientRequestToken: aws.String(event.ClientRequestToken),
+		SecretString:       aws.String(newValue),
+		VersionStages:      []*string{aws.String("AWSPENDING")},
+	})
+	return req.Send()
+}
+
+func (sg *secretGenerator) rotationFinishSecret(event secretsManagerRotationEvent) error {
+	describeReq, describeOut := sg.SecretsManagerClient.DescribeSecretRequest(&secretsmanager.DescribeSecretInput{
+		SecretId: aws.String(event.SecretId),
+	})
+	if err := describeReq.Send(); err != nil {
+		return err
+	}
+
+	var currentVersion string
+	for versionID, stages := range describeOut.VersionIdsToStages {
+		for _, stage := range stages {
+			if aws.StringValue(stage) == "AWSCURRENT" {
+				currentVersion = versionID
+			}
+		}
+	}
+	if currentVersion == event.ClientRequestToken {
+		return nil
+	}
+
+	req, _ := sg.SecretsManagerClient.UpdateSecretVersionStageRequest(&secretsmanager.UpdateSecretVersionStageInput{
+		SecretId:            aws.String(event.SecretId),
+		VersionStage:        aws.String("AWSCURRENT"),
+		MoveToVersionId:     aws.String(event.ClientRequestToken),
+		RemoveFromVersionId: aws.String(currentVersion),
+	})
+	return req.Send()
+}
+
+// isRotatablePassword reports whether value looks like a Custom::Password
+// secret rather than a PEM private key, a KMS key reference, or an
+// SSH certificate - none of which can be rotated by swapping in a new random
+// string of the same length.
+func isRotatablePassword(value string) bool {
+	if strings.HasPrefix(value, "-----BEGIN") {
+		return false
+	}
+	if strings.Contains(value, ":key-id=") {
+		return false
+	}
+	if strings.HasPrefix(value, "ssh-") {
+		return false
+	}
+	return true
+}
+
+// getSecretVersion looks up a secret's value either by versionID (when set)
+// or by staging label.
+func (sg *secretGenerator) getSecretVersion(secretID, versionID, stage string) (string, error) {
+	input := &secretsmanager.GetSecretValueInput{SecretId: aws.String(secretID)}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	} else {
+		input.VersionStage = aws.String(stage)
+	}
+	req, out := sg.SecretsManagerClient.GetSecretValueRequest(input)
+	if err := req.Send(); err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.SecretString), nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultUserExtensions mirrors the extensions OpenSSH grants a normal
+// interactive login, so user certificates behave like a regular key unless
+// the caller asks for something more restrictive.
+var defaultUserExtensions = map[string]string{
+	"permit-X11-forwarding":   "",
+	"permit-agent-forwarding": "",
+	"permit-port-forwarding":  "",
+	"permit-pty":              "",
+	"permit-user-rc":          "",
+}
+
+// handleSSHCertificate signs a caller-supplied SSH public key with a CA key
+// already stored under an SSM parameter (or, for KMS-backed CAs, referenced
+// by a "awskms:key-id=..." KeyRef), turning this Lambda into a small SSH CA.
+func (sg *secretGenerator) handleSSHCertificate() (*responseSecret, error) {
+	if sg.validationError != nil {
+		return nil, sg.validationError
+	}
+	if sg.caKeyName == "" {
+		return nil, errors.New("Missing required property 'CAKeyName'")
+	}
+
+	var pubKey ssh.PublicKey
+	var attestation, attestationFormat string
+	switch {
+	case sg.publicKey != nil:
+		var err error
+		pubKey, _, _, _, err = ssh.ParseAuthorizedKey([]byte(*sg.publicKey))
+		if err != nil {
+			return nil, fmt.Errorf("parsing PublicKey: %w", err)
+		}
+	case sg.attestation != "":
+		var err error
+		pubKey, attestation, attestationFormat, err = sg.generateAttestedSSHKey()
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("Missing required property 'PublicKey'")
+	}
+
+	var sshCertType uint32
+	switch sg.certType {
+	case "user":
+		sshCertType = ssh.UserCert
+	case "host":
+		sshCertType = ssh.HostCert
+	default:
+		return nil, fmt.Errorf("unknown CertType %q", sg.certType)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &ssh.Certificate{
+		Key:             pubKey,
+		Serial:          serial,
+		CertType:        sshCertType,
+		KeyId:           sg.keyID,
+		ValidPrincipals: sg.principals,
+		ValidAfter:      sg.validAfter,
+		ValidBefore:     sg.validBefore,
+		Permissions: ssh.Permissions{
+			CriticalOptions: sg.criticalOptions,
+			Extensions:      sg.extensions,
+		},
+	}
+
+	signer, err := sg.loadCASigner(sg.caKeyName)
+	if err != nil {
+		return nil, fmt.Errorf("loading CA key: %w", err)
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		return nil, err
+	}
+
+	certificate := string(ssh.MarshalAuthorizedKey(cert))
+
+	err = sg.createSSMParameter(sg.Name+"-cert.pub", certificate, "SSH certificate", true)
+
+	response := &responseSecret{Certificate: &certificate}
+	if attestation != "" {
+		response.Attestation = &attestation
+		response.AttestationFormat = &attestationFormat
+	}
+	return response, err
+}
+
+// generateAttestedSSHKey generates a key pair inside the attestable
+// environment named by sg.attestation, instead of signing a caller-supplied
+// PublicKey, storing the attestation document alongside the certificate so
+// relying parties can verify the key never existed outside the enclave/TPM.
+func (sg *secretGenerator) generateAttestedSSHKey() (ssh.PublicKey, string, string, error) {
+	attester, err := attesterFor(sg.attestation, sg.attestationKeyHandle)
+	if err != nil {
+		return nil, "", "", err
+	}
+	pub, _, attestation, format, err := attester.GenerateAttestedKey(KeySpec{Name: sg.Name, Algorithm: "RSA_2048"})
+	if err != nil {
+		return nil, "", "", err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if err := sg.createSSMParameter(sg.Name+"-attestation", string(attestation), "Attestation document", sg.isUpdate); err != nil {
+		return nil, "", "", err
+	}
+	return sshPub, string(attestation), format, nil
+}
+
+// loadCASigner resolves a CAKeyName into an ssh.Signer. A name of the form
+// "awskms:key-id=..." is signed through KMS without the CA key ever being
+// loaded into this process; anything else is treated as an SSM parameter
+// holding a PEM-encoded private key.
+func (sg *secretGenerator) loadCASigner(caKeyName string) (ssh.Signer, error) {
+	if strings.HasPrefix(caKeyName, "awskms:key-id=") {
+		keyID := strings.TrimPrefix(caKeyName, "awskms:key-id=")
+		km := newAWSKMSKeyManager(sg.KMSClient)
+		pub, err := km.GetPublicKey(keyID)
+		if err != nil {
+			return nil, err
+		}
+		signer := &kmsSigner{client: sg.KMSClient, keyID: keyID, public: pub}
+		return wrappedSSHSigner(signer)
+	}
+
+	req, out := sg.SSMClient.GetParameterRequest(&ssm.GetParameterInput{
+		Name:           aws.String(caKeyName),
+		WithDecryption: aws.Bool(true),
+	})
+	if err := req.Send(); err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode([]byte(aws.StringValue(out.Parameter.Value)))
+	if block == nil {
+		return nil, fmt.Errorf("SSM parameter %q does not contain a PEM block", caKeyName)
+	}
+	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(privateKey)
+}
+
+// wrappedSigner adapts a crypto.Signer (such as the KMS-backed kmsSigner)
+// into an ssh.Signer, so CA keys held in KMS can sign certificates without
+// their private half ever leaving KMS.
+type wrappedSigner struct {
+	signer    crypto.Signer
+	publicKey ssh.PublicKey
+}
+
+func wrappedSSHSigner(signer crypto.Signer) (ssh.Signer, error) {
+	publicKey, err := ssh.NewPublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedSigner{signer: signer, publicKey: publicKey}, nil
+}
+
+func (w *wrappedSigner) PublicKey() ssh.PublicKey {
+	return w.publicKey
+}
+
+func (w *wrappedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	digest := sha256.Sum256(data)
+	sig, err := w.signer.Sign(rand, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	return &ssh.Signature{Format: sshSignatureFormat(w.publicKey), Blob: sig}, nil
+}
+
+// sshSignatureFormat reports the SSH signature format for a SHA-256
+// signature over key's algorithm. "ssh-rsa" denotes SHA-1 per the SSH spec,
+// so RSA keys must be declared as "rsa-sha2-256" instead; other key types'
+// own type string already implies SHA-256 (or stronger).
+func sshSignatureFormat(key ssh.PublicKey) string {
+	if key.Type() == ssh.KeyAlgoRSA {
+		return ssh.SigAlgoRSASHA2256
+	}
+	return key.Type()
+}
+
+func randomSerial() (uint64, error) {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func parseStringSlice(v interface{}) ([]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	raw, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("expected a list of strings")
+	}
+	out := make([]string, 0, len(raw))
+	for _, item := range raw {
+		s, ok := item.(string)
+		if !ok {
+			return nil, errors.New("expected a list of strings")
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func parseStringMap(v interface{}) (map[string]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	raw, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("expected a map of strings")
+	}
+	out := make(map[string]string, len(raw))
+	for k, item := range raw {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a string value for %q", k)
+		}
+		out[k] = s
+	}
+	return out, nil
+}
+
+// parseCertTime accepts an RFC3339 timestamp, a relative duration like
+// "+1h" (relative to now), or falls back to def when v is unset.
+func parseCertTime(v interface{}, now time.Time, def time.Time) (uint64, error) {
+	s, ok := v.(string)
+	if !ok || s == "" {
+		return uint64(def.Unix()), nil
+	}
+	if strings.HasPrefix(s, "+") {
+		d, err := time.ParseDuration(strings.TrimPrefix(s, "+"))
+		if err != nil {
+			return 0, err
+		}
+		return uint64(now.Add(d).Unix()), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(t.Unix()), nil
+}